@@ -0,0 +1,243 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pd
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb2"
+	"golang.org/x/net/context"
+)
+
+type regionsRequest struct {
+	keys    [][]byte
+	done    chan error
+	regions []*metapb.Region
+	leaders []*metapb.Peer
+}
+
+type storesRequest struct {
+	ids    []uint64
+	done   chan error
+	stores []*metapb.Store
+}
+
+// GetRegions gets a batch of regions (and their leader Peers) from PD in a
+// single round-trip. Keys already present in the region cache are served
+// locally; the rest are merged with any other GetRegions call in flight at
+// the same time, mirroring how processTSORequests batches concurrent TSO
+// requests.
+func (c *client) GetRegions(ctx context.Context, keys [][]byte) ([]*metapb.Region, []*metapb.Peer, error) {
+	start := time.Now()
+	defer func() { cmdDuration.WithLabelValues("get_regions").Observe(time.Since(start).Seconds()) }()
+
+	regions := make([]*metapb.Region, len(keys))
+	leaders := make([]*metapb.Peer, len(keys))
+	missing := make([]int, 0, len(keys))
+	missingKeys := make([][]byte, 0, len(keys))
+
+	for i, key := range keys {
+		if entry, ok := c.regionCache.getRegion(key); ok {
+			regions[i] = entry.region
+			leaders[i] = entry.leader
+			continue
+		}
+		missing = append(missing, i)
+		missingKeys = append(missingKeys, key)
+	}
+
+	if len(missingKeys) == 0 {
+		return regions, leaders, nil
+	}
+
+	req := &regionsRequest{
+		keys: missingKeys,
+		done: make(chan error, 1),
+	}
+	c.regionsRequests <- req
+
+	select {
+	case err := <-req.done:
+		if err != nil {
+			cmdFailedCounter.WithLabelValues("get_regions").Inc()
+			c.scheduleCheckLeader()
+			return nil, nil, errors.Trace(err)
+		}
+	case <-ctx.Done():
+		return nil, nil, errors.Trace(ctx.Err())
+	}
+
+	for i, idx := range missing {
+		regions[idx] = req.regions[i]
+		leaders[idx] = req.leaders[i]
+		c.regionCache.putRegion(req.regions[i], req.leaders[i])
+	}
+	return regions, leaders, nil
+}
+
+func (c *client) regionsLoop() {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case first := <-c.regionsRequests:
+			c.processRegionsRequests(first)
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *client) processRegionsRequests(first *regionsRequest) {
+	pending := []*regionsRequest{first}
+	n := len(c.regionsRequests)
+	for i := 0; i < n; i++ {
+		pending = append(pending, <-c.regionsRequests)
+	}
+
+	keys := make([][]byte, 0, len(first.keys)*len(pending))
+	for _, req := range pending {
+		keys = append(keys, req.keys...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pdTimeout)
+	cli, addr := c.pickClient(true)
+	resp, err := cli.GetRegions(ctx, &pdpb2.GetRegionsRequest{RegionKeys: keys})
+	cancel()
+
+	if err == nil && (len(resp.GetRegions()) != len(keys) || len(resp.GetLeaders()) != len(keys)) {
+		err = errRegionsLength
+	}
+	if err != nil {
+		c.health.markUnhealthy(addr)
+		for _, req := range pending {
+			req.done <- errors.Trace(err)
+		}
+		return
+	}
+
+	offset := 0
+	for _, req := range pending {
+		req.regions = resp.GetRegions()[offset : offset+len(req.keys)]
+		req.leaders = resp.GetLeaders()[offset : offset+len(req.keys)]
+		offset += len(req.keys)
+		req.done <- nil
+	}
+}
+
+// GetStores gets a batch of stores from PD in a single round-trip. Ids
+// already present in the store cache are served locally, including
+// negatively-cached Tombstone stores, so callers stop hammering PD about
+// stores that are known to be gone.
+func (c *client) GetStores(ctx context.Context, ids []uint64) ([]*metapb.Store, error) {
+	start := time.Now()
+	defer func() { cmdDuration.WithLabelValues("get_stores").Observe(time.Since(start).Seconds()) }()
+
+	stores := make([]*metapb.Store, len(ids))
+	missing := make([]int, 0, len(ids))
+	missingIDs := make([]uint64, 0, len(ids))
+
+	for i, id := range ids {
+		if entry, ok := c.storeCache.getStore(id); ok {
+			if !entry.tombstone {
+				stores[i] = entry.store
+			}
+			continue
+		}
+		missing = append(missing, i)
+		missingIDs = append(missingIDs, id)
+	}
+
+	if len(missingIDs) == 0 {
+		return stores, nil
+	}
+
+	req := &storesRequest{
+		ids:  missingIDs,
+		done: make(chan error, 1),
+	}
+	c.storesRequests <- req
+
+	select {
+	case err := <-req.done:
+		if err != nil {
+			cmdFailedCounter.WithLabelValues("get_stores").Inc()
+			c.scheduleCheckLeader()
+			return nil, errors.Trace(err)
+		}
+	case <-ctx.Done():
+		return nil, errors.Trace(ctx.Err())
+	}
+
+	for i, idx := range missing {
+		store := req.stores[i]
+		tombstone := store != nil && store.GetState() == metapb.StoreState_Tombstone
+		c.storeCache.putStore(missingIDs[i], store, tombstone)
+		if !tombstone {
+			stores[idx] = store
+		}
+	}
+	return stores, nil
+}
+
+func (c *client) storesLoop() {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case first := <-c.storesRequests:
+			c.processStoresRequests(first)
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *client) processStoresRequests(first *storesRequest) {
+	pending := []*storesRequest{first}
+	n := len(c.storesRequests)
+	for i := 0; i < n; i++ {
+		pending = append(pending, <-c.storesRequests)
+	}
+
+	ids := make([]uint64, 0, len(first.ids)*len(pending))
+	for _, req := range pending {
+		ids = append(ids, req.ids...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pdTimeout)
+	cli, addr := c.pickClient(true)
+	resp, err := cli.GetStores(ctx, &pdpb2.GetStoresRequest{StoreIds: ids})
+	cancel()
+
+	if err == nil && len(resp.GetStores()) != len(ids) {
+		err = errStoresLength
+	}
+	if err != nil {
+		c.health.markUnhealthy(addr)
+		for _, req := range pending {
+			req.done <- errors.Trace(err)
+		}
+		return
+	}
+
+	offset := 0
+	for _, req := range pending {
+		req.stores = resp.GetStores()[offset : offset+len(req.ids)]
+		offset += len(req.ids)
+		req.done <- nil
+	}
+}
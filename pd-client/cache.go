@@ -0,0 +1,248 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pd
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+)
+
+const (
+	defaultCacheTTL      = 10 * time.Second
+	defaultCacheCapacity = 64 * 1024
+)
+
+type regionCacheEntry struct {
+	region  *metapb.Region
+	leader  *metapb.Peer
+	expires time.Time
+}
+
+type storeCacheEntry struct {
+	store     *metapb.Store
+	tombstone bool
+	expires   time.Time
+}
+
+// ttlLRUCache is a fixed-capacity, TTL-bounded LRU cache. It is used to
+// cache region and store lookups on the client side so repeated scans over
+// the same keys or ids do not each cost a PD round-trip. Entries past their
+// TTL are treated as misses but are not proactively evicted; eviction only
+// happens on capacity pressure, so a cold client does not pay sweep cost.
+type ttlLRUCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	capacity int
+	ll       *list.List
+	items    map[interface{}]*list.Element
+
+	// regionStarts holds the start key of every cached region entry, kept
+	// sorted so getRegion can find the region whose [StartKey, EndKey) range
+	// covers a queried key instead of requiring an exact-key match. It is
+	// only populated by putRegion and is unused (and harmlessly
+	// empty) on a cache used for anything else, e.g. the store cache.
+	regionStarts []string
+}
+
+type cacheElement struct {
+	key   interface{}
+	value interface{}
+}
+
+func newTTLLRUCache(ttl time.Duration, capacity int) *ttlLRUCache {
+	return &ttlLRUCache{
+		ttl:      ttl,
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[interface{}]*list.Element),
+	}
+}
+
+func (c *ttlLRUCache) get(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*cacheElement).value, true
+}
+
+func (c *ttlLRUCache) put(key, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		e.Value.(*cacheElement).value = value
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	e := c.ll.PushFront(&cacheElement{key: key, value: value})
+	c.items[key] = e
+	for c.ll.Len() > c.capacity {
+		c.evictOldest()
+	}
+}
+
+func (c *ttlLRUCache) evictOldest() {
+	e := c.ll.Back()
+	if e == nil {
+		return
+	}
+	c.ll.Remove(e)
+	key := e.Value.(*cacheElement).key
+	delete(c.items, key)
+	if startKey, ok := key.(string); ok {
+		c.removeRegionStartLocked(startKey)
+	}
+}
+
+func (c *ttlLRUCache) remove(key interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.Remove(e)
+		delete(c.items, key)
+		if startKey, ok := key.(string); ok {
+			c.removeRegionStartLocked(startKey)
+		}
+	}
+}
+
+// insertRegionStartLocked records startKey in the sorted regionStarts index,
+// if it is not already present. Callers must hold c.mu.
+func (c *ttlLRUCache) insertRegionStartLocked(startKey string) {
+	i := sort.Search(len(c.regionStarts), func(i int) bool { return c.regionStarts[i] >= startKey })
+	if i < len(c.regionStarts) && c.regionStarts[i] == startKey {
+		return
+	}
+	c.regionStarts = append(c.regionStarts, "")
+	copy(c.regionStarts[i+1:], c.regionStarts[i:])
+	c.regionStarts[i] = startKey
+}
+
+// removeRegionStartLocked drops startKey from the sorted regionStarts index,
+// if present. Callers must hold c.mu.
+func (c *ttlLRUCache) removeRegionStartLocked(startKey string) {
+	i := sort.Search(len(c.regionStarts), func(i int) bool { return c.regionStarts[i] >= startKey })
+	if i < len(c.regionStarts) && c.regionStarts[i] == startKey {
+		c.regionStarts = append(c.regionStarts[:i], c.regionStarts[i+1:]...)
+	}
+}
+
+// findRegionStartLocked returns the start key of the cached region whose
+// [StartKey, EndKey) range covers key, if any is indexed. It does not check
+// expiry; callers that care must do so themselves. Callers must hold c.mu.
+func (c *ttlLRUCache) findRegionStartLocked(key string) (string, bool) {
+	i := sort.Search(len(c.regionStarts), func(i int) bool { return c.regionStarts[i] > key })
+	if i == 0 {
+		return "", false
+	}
+	startKey := c.regionStarts[i-1]
+	e, ok := c.items[startKey]
+	if !ok {
+		return "", false
+	}
+	entry := e.Value.(*cacheElement).value.(*regionCacheEntry)
+	if end := entry.region.GetEndKey(); len(end) > 0 && key >= string(end) {
+		return "", false
+	}
+	return startKey, true
+}
+
+// getRegion looks up the cached region whose [StartKey, EndKey) range
+// covers key. Unlike the generic get, this is not an exact-match lookup:
+// the cache is keyed by region start key so that a single cached region
+// serves every key in its range, not just the one it was looked up by.
+func (c *ttlLRUCache) getRegion(key []byte) (*regionCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	startKey, ok := c.findRegionStartLocked(string(key))
+	if !ok {
+		return nil, false
+	}
+	e := c.items[startKey]
+	entry := e.Value.(*cacheElement).value.(*regionCacheEntry)
+	if time.Now().After(entry.expires) {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return entry, true
+}
+
+// putRegion caches region keyed by its start key. A nil region (PD found no
+// region for the query, possibly transiently) is never cached, so callers
+// keep retrying PD instead of being stuck with a negative result for the
+// full TTL; see the Client interface's GetRegion doc comment.
+func (c *ttlLRUCache) putRegion(region *metapb.Region, leader *metapb.Peer) {
+	if region == nil {
+		return
+	}
+
+	startKey := string(region.GetStartKey())
+	entry := &regionCacheEntry{region: region, leader: leader, expires: time.Now().Add(c.ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[startKey]; ok {
+		e.Value.(*cacheElement).value = entry
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	e := c.ll.PushFront(&cacheElement{key: startKey, value: entry})
+	c.items[startKey] = e
+	c.insertRegionStartLocked(startKey)
+	for c.ll.Len() > c.capacity {
+		c.evictOldest()
+	}
+}
+
+// removeRegion drops the cached region whose [StartKey, EndKey) range
+// covers key, if any, so the next lookup for it falls through to PD.
+func (c *ttlLRUCache) removeRegion(key []byte) {
+	c.mu.Lock()
+	startKey, ok := c.findRegionStartLocked(string(key))
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	c.remove(startKey)
+}
+
+func (c *ttlLRUCache) getStore(id uint64) (*storeCacheEntry, bool) {
+	v, ok := c.get(id)
+	if !ok {
+		return nil, false
+	}
+	entry := v.(*storeCacheEntry)
+	if time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (c *ttlLRUCache) putStore(id uint64, store *metapb.Store, tombstone bool) {
+	c.put(id, &storeCacheEntry{store: store, tombstone: tombstone, expires: time.Now().Add(c.ttl)})
+}
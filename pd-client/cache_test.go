@@ -0,0 +1,115 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+)
+
+func TestTTLLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newTTLLRUCache(time.Minute, 2)
+
+	c.put("a", 1)
+	c.put("b", 2)
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a should still be cached")
+	}
+	// Touching "a" makes "b" the least recently used.
+	c.put("c", 3)
+	if _, ok := c.get("b"); ok {
+		t.Fatal("b should have been evicted to make room for c")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a should survive eviction since it was used more recently than b")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Fatal("c should be cached")
+	}
+}
+
+func TestTTLLRUCacheExpiresEntries(t *testing.T) {
+	c := newTTLLRUCache(10*time.Millisecond, 16)
+
+	c.putRegion(&metapb.Region{Id: 1, StartKey: []byte("a"), EndKey: []byte("z")}, &metapb.Peer{Id: 2})
+	if _, ok := c.getRegion([]byte("m")); !ok {
+		t.Fatal("entry should be present before its TTL elapses")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.getRegion([]byte("m")); ok {
+		t.Fatal("entry should have expired")
+	}
+}
+
+// TestTTLLRUCacheGetRegionIsOverlapAware ensures a single cached region
+// serves any key within its [StartKey, EndKey) range, not just the literal
+// key it was looked up with, and that a lookup outside the range misses.
+func TestTTLLRUCacheGetRegionIsOverlapAware(t *testing.T) {
+	c := newTTLLRUCache(time.Minute, 16)
+
+	region := &metapb.Region{Id: 1, StartKey: []byte("b"), EndKey: []byte("d")}
+	c.putRegion(region, &metapb.Peer{Id: 2})
+
+	for _, key := range [][]byte{[]byte("b"), []byte("bb"), []byte("c")} {
+		entry, ok := c.getRegion(key)
+		if !ok || entry.region != region {
+			t.Fatalf("getRegion(%q) = (%v, %v), want the cached region", key, entry, ok)
+		}
+	}
+
+	if _, ok := c.getRegion([]byte("a")); ok {
+		t.Fatal("getRegion should miss for a key before the cached region's start")
+	}
+	if _, ok := c.getRegion([]byte("d")); ok {
+		t.Fatal("getRegion should miss for a key at or after the cached region's end")
+	}
+}
+
+// TestTTLLRUCacheDoesNotCacheNilRegion ensures a PD "no region found"
+// result is never cached, so callers retry PD promptly instead of being
+// stuck with a stale negative result for the full TTL.
+func TestTTLLRUCacheDoesNotCacheNilRegion(t *testing.T) {
+	c := newTTLLRUCache(time.Minute, 16)
+
+	c.putRegion(nil, nil)
+	if _, ok := c.getRegion([]byte("anything")); ok {
+		t.Fatal("a nil region result should never be cached")
+	}
+}
+
+func TestTTLLRUCacheStoreTombstoneNegativeCache(t *testing.T) {
+	c := newTTLLRUCache(time.Minute, 16)
+
+	c.putStore(42, nil, true)
+	entry, ok := c.getStore(42)
+	if !ok {
+		t.Fatal("tombstoned store id should still be a cache hit")
+	}
+	if !entry.tombstone {
+		t.Fatal("entry should be marked tombstone so callers stop hammering PD for it")
+	}
+}
+
+func TestTTLLRUCacheRemove(t *testing.T) {
+	c := newTTLLRUCache(time.Minute, 16)
+
+	c.putStore(1, &metapb.Store{Id: 1}, false)
+	c.remove(uint64(1))
+	if _, ok := c.getStore(1); ok {
+		t.Fatal("removed entry should no longer be cached")
+	}
+}
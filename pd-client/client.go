@@ -14,6 +14,7 @@
 package pd
 
 import (
+	"crypto/tls"
 	"net"
 	"net/url"
 	"strings"
@@ -27,6 +28,7 @@ import (
 	"github.com/pingcap/pd/pkg/apiutil"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // Client is a PD (Placement Driver) client.
@@ -36,30 +38,72 @@ type Client interface {
 	GetClusterID(ctx context.Context) uint64
 	// GetTS gets a timestamp from PD.
 	GetTS(ctx context.Context) (int64, int64, error)
-	// GetRegion gets a region and its leader Peer from PD by key.
-	// The region may expire after split. Caller is responsible for caching and
-	// taking care of region change.
+	// GetRegion gets a region and its leader Peer from PD by key. Results
+	// are served from an internal TTL cache where possible; the region may
+	// still expire after a split, so the client, not just the cache TTL,
+	// remains responsible for tolerating region change.
 	// Also it may return nil if PD finds no Region for the key temporarily,
 	// client should retry later.
 	GetRegion(ctx context.Context, key []byte) (*metapb.Region, *metapb.Peer, error)
-	// GetStore gets a store from PD by store id.
-	// The store may expire later. Caller is responsible for caching and taking care
-	// of store change.
+	// GetStore gets a store from PD by store id. Results are served from an
+	// internal TTL cache where possible, including negatively-cached
+	// Tombstone stores; the store may still expire later, so the client
+	// remains responsible for tolerating store change.
 	GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error)
+	// GetRegions gets the regions and their leader Peers for a batch of keys from
+	// PD, in one round-trip, coalescing with any other GetRegions call that is
+	// in flight at the same time. Results are served from an internal TTL cache
+	// where possible.
+	GetRegions(ctx context.Context, keys [][]byte) ([]*metapb.Region, []*metapb.Peer, error)
+	// GetStores gets a batch of stores from PD by store id, in one round-trip,
+	// coalescing with any other GetStores call that is in flight at the same
+	// time. Results are served from an internal TTL cache where possible.
+	GetStores(ctx context.Context, ids []uint64) ([]*metapb.Store, error)
+	// InvalidateRegionCache drops any cached entry for the region covering key,
+	// forcing the next GetRegion/GetRegions call for it to hit PD.
+	InvalidateRegionCache(key []byte)
+	// InvalidateStoreCache drops any cached entry for storeID, forcing the next
+	// GetStore/GetStores call for it to hit PD.
+	InvalidateStoreCache(storeID uint64)
+	// OnMemberChange registers a callback that is invoked, with the newly
+	// discovered set of member URLs, whenever the background member
+	// discovery loop reconciles a membership change. Embedders that keep
+	// their own routing tables can use this to mirror PD's membership
+	// without polling GetMembers themselves.
+	OnMemberChange(cb func(members []string))
 	// Close closes the client.
 	Close()
 }
 
 type tsoRequest struct {
-	done     chan error
+	done chan error
+	// count is the number of consecutive timestamps this request wants.
+	// Ordinary GetTS calls want 1; localTSOAllocator's lease refills want
+	// a whole batch, merged into the same Tso RPC as any other pending
+	// request via processTSORequests so a lease refill does not bypass
+	// the maxMergeTSORequests batching ordinary GetTS calls get.
+	count uint32
+	// lease marks this request as a lease refill, purely so the merged
+	// Tso RPC can be tagged with TsoRequest.Lease when any request in the
+	// batch is one.
+	lease    bool
 	physical int64
-	logical  int64
+	// logical is the timestamp's logical value for a count == 1 request,
+	// or the first logical value of the granted range for count > 1.
+	logical int64
 }
 
 const (
 	pdTimeout             = 3 * time.Second
 	maxMergeTSORequests   = 10000
+	maxMergeBatchRequests = 10000
 	maxInitClusterRetries = 100
+
+	// maxReadRetries bounds how many attempts GetRegion/GetStore make,
+	// re-picking a candidate through pickClient on each one, before giving
+	// up, so a persistently-failing cluster cannot spin the caller forever.
+	maxReadRetries   = 3
+	readRetryBackoff = 100 * time.Millisecond
 )
 
 var (
@@ -69,54 +113,142 @@ var (
 	errClosing = errors.New("[pd] closing")
 	// errTSOLength is returned when the number of response timestamps is inconsistent with request.
 	errTSOLength = errors.New("[pd] tso length in rpc response is incorrect")
+	// errRegionsLength is returned when the number of regions/leaders in a GetRegions response is inconsistent with request.
+	errRegionsLength = errors.New("[pd] regions length in rpc response is incorrect")
+	// errStoresLength is returned when the number of stores in a GetStores response is inconsistent with request.
+	errStoresLength = errors.New("[pd] stores length in rpc response is incorrect")
 )
 
 type client struct {
-	urls        []string
-	clusterID   uint64
-	tsoRequests chan *tsoRequest
+	urls            []string
+	clusterID       uint64
+	tsoRequests     chan *tsoRequest
+	regionsRequests chan *regionsRequest
+	storesRequests  chan *storesRequest
 
 	mu            sync.RWMutex // TODO: use embedded struct style.
 	clients       map[string]pdpb2.PDClient
+	conns         map[string]*grpc.ClientConn
 	leader        string
 	checkLeaderCh chan struct{}
 
+	tlsCfg *tls.Config
+
+	health      *healthBalancer
+	regionCache *ttlLRUCache
+	storeCache  *ttlLRUCache
+
+	endpointStore  EndpointStore
+	memberChangeCb func(members []string)
+
+	allocator tsoAllocator
+
 	wg   sync.WaitGroup
 	quit chan struct{}
 }
 
 // NewClient creates a PD client.
 func NewClient(pdAddrs []string) (Client, error) {
+	return NewClientWithTLS(pdAddrs, nil)
+}
+
+// NewClientWithTLS creates a PD client that dials its gRPC connections and
+// issues its HTTP leader lookups using the given TLS config. Pass a nil
+// cfg to get the previous plaintext behavior.
+func NewClientWithTLS(pdAddrs []string, tlsCfg *tls.Config) (Client, error) {
+	return NewClientWithOptions(pdAddrs, tlsCfg, nil, TSOConfig{})
+}
+
+// NewClientWithOptions creates a PD client with a pluggable EndpointStore
+// and TSO allocation strategy.
+//
+// The store seeds the initial member list (falling back to pdAddrs if it
+// has nothing persisted yet) and is updated whenever the background
+// discovery loop observes a membership change, so a client restarted after
+// the original seeds are gone can still bootstrap. Pass a nil store to get
+// an in-memory-only client that always starts from pdAddrs.
+//
+// tsoCfg.Type selects how GetTS is served; see TSOAllocatorType. The zero
+// value of TSOConfig requests the default RemoteTSOAllocator, preserving
+// the original one-RPC-per-merged-batch behavior.
+func NewClientWithOptions(pdAddrs []string, tlsCfg *tls.Config, store EndpointStore, tsoCfg TSOConfig) (Client, error) {
 	log.Infof("[pd] create pd client with endpoints %v", pdAddrs)
+	if store == nil {
+		store = noopEndpointStore{}
+	}
+
+	urls := addrsToUrls(pdAddrs)
+	if saved, err := store.Load(); err == nil && len(saved) > 0 {
+		urls = saved
+	}
+	if tlsCfg != nil {
+		if err := rejectPlaintextURLs(urls); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
 	c := &client{
-		urls:          addrsToUrls(pdAddrs),
-		tsoRequests:   make(chan *tsoRequest, maxMergeTSORequests),
-		clients:       make(map[string]pdpb2.PDClient),
-		checkLeaderCh: make(chan struct{}, 1),
-		quit:          make(chan struct{}),
+		urls:            urls,
+		tsoRequests:     make(chan *tsoRequest, maxMergeTSORequests),
+		regionsRequests: make(chan *regionsRequest, maxMergeBatchRequests),
+		storesRequests:  make(chan *storesRequest, maxMergeBatchRequests),
+		clients:         make(map[string]pdpb2.PDClient),
+		conns:           make(map[string]*grpc.ClientConn),
+		checkLeaderCh:   make(chan struct{}, 1),
+		tlsCfg:          tlsCfg,
+		regionCache:     newTTLLRUCache(defaultCacheTTL, defaultCacheCapacity),
+		storeCache:      newTTLLRUCache(defaultCacheTTL, defaultCacheCapacity),
+		endpointStore:   store,
+		quit:            make(chan struct{}),
 	}
 
+	c.health = newHealthBalancer(c)
+
 	if err := c.initClusterID(); err != nil {
 		return nil, errors.Trace(err)
 	}
 	if err := c.updateLeader(); err != nil {
 		return nil, errors.Trace(err)
 	}
+	c.dialKnownMembers()
 	log.Infof("[pd] init cluster id %v", c.clusterID)
 
-	c.wg.Add(2)
+	c.wg.Add(6)
 	go c.tsLoop()
 	go c.leaderLoop()
-
-	// TODO: Update addrs from server continuously by using GetMember.
+	go c.health.probeLoop()
+	go c.regionsLoop()
+	go c.storesLoop()
+	go c.discoveryLoop()
+
+	// newTSOAllocator must run after the loops above start: HybridTSOAllocator
+	// seeds itself with a synchronous PD fetch (see tso_allocator.go) that is
+	// served through getTSRemote, which depends on tsLoop already running. If
+	// it fails, stop those loops and release dialKnownMembers' connections
+	// rather than leaking them back to the caller along with the error.
+	allocator, err := newTSOAllocator(c, tsoCfg)
+	if err != nil {
+		c.stopLoopsAndConns()
+		return nil, errors.Trace(err)
+	}
+	c.allocator = allocator
 
 	return c, nil
 }
 
+// OnMemberChange registers cb to be called with the current member URLs
+// whenever discoveryLoop reconciles a membership change. Only one callback
+// may be registered at a time; registering again replaces the previous one.
+func (c *client) OnMemberChange(cb func(members []string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.memberChangeCb = cb
+}
+
 func (c *client) initClusterID() error {
 	for i := 0; i < maxInitClusterRetries; i++ {
 		for _, u := range c.urls {
-			client, err := apiutil.NewClient(u, pdTimeout)
+			client, err := apiutil.NewClient(u, pdTimeout, c.tlsCfg)
 			if err != nil {
 				log.Errorf("[pd] failed to get cluster id: %v", err)
 				continue
@@ -137,8 +269,12 @@ func (c *client) initClusterID() error {
 }
 
 func (c *client) updateLeader() error {
-	for _, u := range c.urls {
-		client, err := apiutil.NewClient(u, pdTimeout)
+	c.mu.RLock()
+	urls := append([]string(nil), c.urls...)
+	c.mu.RUnlock()
+
+	for _, u := range urls {
+		client, err := apiutil.NewClient(u, pdTimeout, c.tlsCfg)
 		if err != nil {
 			continue
 		}
@@ -156,7 +292,7 @@ func (c *client) updateLeader() error {
 		}
 		return nil
 	}
-	return errors.Errorf("failed to get leader from %v", c.urls)
+	return errors.Errorf("failed to get leader from %v", urls)
 }
 
 func (c *client) switchLeader(addr string) error {
@@ -164,23 +300,58 @@ func (c *client) switchLeader(addr string) error {
 	defer c.mu.Unlock()
 
 	log.Infof("[pd] leader switches to: %v, previous: %v", addr, c.leader)
-	if _, ok := c.clients[addr]; !ok {
-		cc, err := grpc.Dial(addr, grpc.WithDialer(func(addr string, d time.Duration) (net.Conn, error) {
-			u, err := url.Parse(addr)
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
-			return net.DialTimeout(u.Scheme, u.Host, d)
-		}), grpc.WithInsecure())
+	if err := c.ensureClientLocked(addr); err != nil {
+		return errors.Trace(err)
+	}
+	c.leader = addr
+	c.health.markHealthy(addr)
+	return nil
+}
+
+// ensureClientLocked dials addr if it is not already known. c.mu must be
+// held for writing.
+func (c *client) ensureClientLocked(addr string) error {
+	if _, ok := c.clients[addr]; ok {
+		return nil
+	}
+
+	dialer := grpc.WithDialer(func(addr string, d time.Duration) (net.Conn, error) {
+		u, err := url.Parse(addr)
 		if err != nil {
-			return errors.Trace(err)
+			return nil, errors.Trace(err)
 		}
-		c.clients[addr] = pdpb2.NewPDClient(cc)
+		return net.DialTimeout(u.Scheme, u.Host, d)
+	})
+	security := grpc.WithInsecure()
+	if c.tlsCfg != nil {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(c.tlsCfg))
 	}
-	c.leader = addr
+	cc, err := grpc.Dial(addr, dialer, security)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.conns[addr] = cc
+	c.clients[addr] = pdpb2.NewPDClient(cc)
 	return nil
 }
 
+// dialKnownMembers dials every seed URL the client was constructed with, not
+// just the leader, so the health balancer's follower fallback has
+// candidates to pick from from the moment the client starts, rather than
+// only after a leader change or discoveryLoop's first pass (up to a minute
+// later). Members that fail to dial are simply left out of c.clients;
+// discoveryLoop or a later leader switch will retry them.
+func (c *client) dialKnownMembers() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, addr := range c.urls {
+		if err := c.ensureClientLocked(addr); err != nil {
+			log.Errorf("[pd] failed to dial member %v: %v", addr, err)
+		}
+	}
+}
+
 func (c *client) leaderLoop() {
 	defer c.wg.Done()
 
@@ -211,42 +382,81 @@ func (c *client) tsLoop() {
 	}
 }
 
+// processTSORequests merges first with every other request already queued
+// up in c.tsoRequests (ordinary GetTS calls and, since they're requests on
+// the same channel, localTSOAllocator lease refills alike) into a single
+// Tso RPC whose Count is the sum of every request's wanted count, then
+// slices the granted range back out per request.
 func (c *client) processTSORequests(first *tsoRequest) {
 	start := time.Now()
 	ctx, cancel := context.WithTimeout(context.Background(), pdTimeout)
 
 	pendingCount := len(c.tsoRequests)
+	pending := make([]*tsoRequest, pendingCount)
+	totalCount := first.count
+	lease := first.lease
+	for i := 0; i < pendingCount; i++ {
+		req := <-c.tsoRequests
+		pending[i] = req
+		totalCount += req.count
+		lease = lease || req.lease
+	}
+
 	resp, err := c.leaderClient().Tso(ctx, &pdpb2.TsoRequest{
 		Header: &pdpb2.RequestHeader{ClusterId: c.clusterID},
-		Count:  uint32(pendingCount + 1),
+		Count:  totalCount,
+		Lease:  lease,
 	})
 	cancel()
 	requestDuration.WithLabelValues("tso").Observe(time.Since(start).Seconds())
-	if err == nil && resp.GetCount() != uint32(pendingCount+1) {
+	if err == nil && resp.GetCount() != totalCount {
 		err = errTSOLength
 	}
 	if err != nil {
+		c.mu.RLock()
+		leader := c.leader
+		c.mu.RUnlock()
+		c.health.markUnhealthy(leader)
 		c.finishTSORequest(first, 0, 0, errors.Trace(err))
-		for i := 0; i < pendingCount; i++ {
-			c.finishTSORequest(<-c.tsoRequests, 0, 0, errors.Trace(err))
+		for _, req := range pending {
+			c.finishTSORequest(req, 0, 0, errors.Trace(err))
 		}
 		return
 	}
 
 	physical, logical := resp.GetTimestamp().GetPhysical(), resp.GetTimestamp().GetLogical()
-	c.finishTSORequest(first, physical, logical, nil)
-	for i := 0; i < pendingCount; i++ {
-		logical--
-		c.finishTSORequest(<-c.tsoRequests, physical, logical, nil)
+	logical = c.finishTSORequestRange(first, physical, logical)
+	for _, req := range pending {
+		logical = c.finishTSORequestRange(req, physical, logical)
 	}
 }
 
+// finishTSORequestRange completes req with the physical time and the first
+// logical value of the req.count-sized chunk ending at logical, then
+// returns the logical value one below that chunk so the caller can hand
+// the next request its own chunk out of the same granted range.
+func (c *client) finishTSORequestRange(req *tsoRequest, physical, logical int64) int64 {
+	logicalStart := logical - int64(req.count) + 1
+	c.finishTSORequest(req, physical, logicalStart, nil)
+	return logicalStart - 1
+}
+
 func (c *client) finishTSORequest(req *tsoRequest, physical, logical int64, err error) {
 	req.physical, req.logical = physical, logical
 	req.done <- err
 }
 
 func (c *client) Close() {
+	c.stopLoopsAndConns()
+	c.allocator.close()
+}
+
+// stopLoopsAndConns signals the background loops started by
+// NewClientWithOptions to stop, waits for them to exit, fails any requests
+// still queued up for them, and closes every dialed connection. It does
+// not touch c.allocator: besides backing Close, it also unwinds
+// construction when newTSOAllocator fails, before c.allocator is set.
+func (c *client) stopLoopsAndConns() {
 	close(c.quit)
 	c.wg.Wait()
 
@@ -255,8 +465,38 @@ func (c *client) Close() {
 		req := <-c.tsoRequests
 		req.done <- errors.Trace(errClosing)
 	}
+
+	for i, n := 0, len(c.regionsRequests); i < n; i++ {
+		req := <-c.regionsRequests
+		req.done <- errors.Trace(errClosing)
+	}
+	for i, n := 0, len(c.storesRequests); i < n; i++ {
+		req := <-c.storesRequests
+		req.done <- errors.Trace(errClosing)
+	}
+
+	c.mu.Lock()
+	for addr, cc := range c.conns {
+		if err := cc.Close(); err != nil {
+			log.Errorf("[pd] failed to close connection to %v: %v", addr, err)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// InvalidateRegionCache drops any cached entry for the region covering key.
+func (c *client) InvalidateRegionCache(key []byte) {
+	c.regionCache.removeRegion(key)
 }
 
+// InvalidateStoreCache drops any cached entry for storeID.
+func (c *client) InvalidateStoreCache(storeID uint64) {
+	c.storeCache.remove(storeID)
+}
+
+// leaderClient returns the PDClient for the current leader, regardless of
+// its health. It is used for requests, such as Tso, that must go to the
+// leader and cannot be served by a follower.
 func (c *client) leaderClient() pdpb2.PDClient {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -264,6 +504,42 @@ func (c *client) leaderClient() pdpb2.PDClient {
 	return c.clients[c.leader]
 }
 
+// pickClient returns a PDClient to issue a request against, together with
+// the address it was picked for so the caller can report failures back to
+// the health balancer. If readOnly is true and the leader is currently
+// marked unhealthy, a healthy follower is returned instead.
+func (c *client) pickClient(readOnly bool) (pdpb2.PDClient, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if readOnly && !c.health.isHealthy(c.leader) {
+		candidates := make([]string, 0, len(c.clients))
+		for addr := range c.clients {
+			if addr != c.leader {
+				candidates = append(candidates, addr)
+			}
+		}
+		if addr, ok := c.health.pickHealthyFollower(candidates); ok {
+			return c.clients[addr], addr
+		}
+	}
+	return c.clients[c.leader], c.leader
+}
+
+// sleepRetryBackoff waits out a short backoff before the next read retry,
+// returning early with ctx.Err() if ctx is done first.
+func sleepRetryBackoff(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(readRetryBackoff * time.Duration(attempt+1))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (c *client) scheduleCheckLeader() {
 	select {
 	case c.checkLeaderCh <- struct{}{}:
@@ -279,8 +555,26 @@ func (c *client) GetTS(ctx context.Context) (int64, int64, error) {
 	start := time.Now()
 	defer func() { cmdDuration.WithLabelValues("tso").Observe(time.Since(start).Seconds()) }()
 
+	return c.allocator.getTS(ctx)
+}
+
+// getTSRemote is the original GetTS behavior: it merges this request with
+// any other concurrently pending request via tsLoop/processTSORequests and
+// issues a single Tso RPC against the leader. It backs remoteTSOAllocator
+// directly, and backs hybridTSOAllocator's refresh path; localTSOAllocator
+// refills through requestTSOLease instead.
+func (c *client) getTSRemote(ctx context.Context) (int64, int64, error) {
+	return c.requestTSO(ctx, 1, false)
+}
+
+// requestTSO queues a request for count consecutive timestamps onto
+// c.tsoRequests, to be merged with any other request pending at the same
+// time by processTSORequests, and waits for tsLoop to fill it in.
+func (c *client) requestTSO(ctx context.Context, count uint32, lease bool) (int64, int64, error) {
 	req := &tsoRequest{
-		done: make(chan error, 1),
+		done:  make(chan error, 1),
+		count: count,
+		lease: lease,
 	}
 	c.tsoRequests <- req
 
@@ -300,46 +594,102 @@ func (c *client) GetTS(ctx context.Context) (int64, int64, error) {
 func (c *client) GetRegion(ctx context.Context, key []byte) (*metapb.Region, *metapb.Peer, error) {
 	start := time.Now()
 	defer func() { cmdDuration.WithLabelValues("get_region").Observe(time.Since(start).Seconds()) }()
-	ctx, cancel := context.WithTimeout(ctx, pdTimeout)
-	defer cancel()
 
-	resp, err := c.leaderClient().GetRegion(ctx, &pdpb2.GetRegionRequest{RegionKey: key})
-	requestDuration.WithLabelValues("get_region").Observe(time.Since(start).Seconds())
+	if entry, ok := c.regionCache.getRegion(key); ok {
+		return entry.region, entry.leader, nil
+	}
 
-	if err != nil {
-		cmdFailedCounter.WithLabelValues("get_region").Inc()
-		c.scheduleCheckLeader()
-		return nil, nil, errors.Trace(err)
+	var lastErr error
+	for attempt := 0; attempt < maxReadRetries; attempt++ {
+		reqCtx, cancel := context.WithTimeout(ctx, pdTimeout)
+		cli, addr := c.pickClient(true)
+		resp, err := cli.GetRegion(reqCtx, &pdpb2.GetRegionRequest{RegionKey: key})
+		cancel()
+		requestDuration.WithLabelValues("get_region").Observe(time.Since(start).Seconds())
+
+		if err != nil {
+			cmdFailedCounter.WithLabelValues("get_region").Inc()
+			c.health.markUnhealthy(addr)
+			c.scheduleCheckLeader()
+			lastErr = err
+			if sleepErr := sleepRetryBackoff(ctx, attempt); sleepErr != nil {
+				return nil, nil, errors.Trace(sleepErr)
+			}
+			continue
+		}
+		region, leader := resp.GetRegion(), resp.GetLeader()
+		c.regionCache.putRegion(region, leader)
+		return region, leader, nil
 	}
-	return resp.GetRegion(), resp.GetLeader(), nil
+	return nil, nil, errors.Trace(lastErr)
 }
 
 func (c *client) GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error) {
 	start := time.Now()
 	defer func() { cmdDuration.WithLabelValues("get_store").Observe(time.Since(start).Seconds()) }()
-	ctx, cancel := context.WithTimeout(ctx, pdTimeout)
-	defer cancel()
 
-	resp, err := c.leaderClient().GetStore(ctx, &pdpb2.GetStoreRequest{StoreId: storeID})
-	requestDuration.WithLabelValues("get_store").Observe(time.Since(start).Seconds())
+	if entry, ok := c.storeCache.getStore(storeID); ok {
+		if entry.tombstone {
+			return nil, nil
+		}
+		return entry.store, nil
+	}
 
-	if err != nil {
-		cmdFailedCounter.WithLabelValues("get_store").Inc()
-		c.scheduleCheckLeader()
-		return nil, errors.Trace(err)
+	var resp *pdpb2.GetStoreResponse
+	var lastErr error
+	for attempt := 0; attempt < maxReadRetries; attempt++ {
+		reqCtx, cancel := context.WithTimeout(ctx, pdTimeout)
+		cli, addr := c.pickClient(true)
+		r, err := cli.GetStore(reqCtx, &pdpb2.GetStoreRequest{StoreId: storeID})
+		cancel()
+		requestDuration.WithLabelValues("get_store").Observe(time.Since(start).Seconds())
+
+		if err != nil {
+			cmdFailedCounter.WithLabelValues("get_store").Inc()
+			c.health.markUnhealthy(addr)
+			c.scheduleCheckLeader()
+			lastErr = err
+			if sleepErr := sleepRetryBackoff(ctx, attempt); sleepErr != nil {
+				return nil, errors.Trace(sleepErr)
+			}
+			continue
+		}
+		resp = r
+		break
 	}
+	if resp == nil {
+		return nil, errors.Trace(lastErr)
+	}
+
 	store := resp.GetStore()
 	if store == nil {
 		return nil, errors.New("[pd] store field in rpc response not set")
 	}
-	if store.GetState() == metapb.StoreState_Tombstone {
+	tombstone := store.GetState() == metapb.StoreState_Tombstone
+	c.storeCache.putStore(storeID, store, tombstone)
+	if tombstone {
 		return nil, nil
 	}
 	return store, nil
 }
 
+// rejectPlaintextURLs returns an error naming the first plaintext ("http://")
+// URL in urls, if any. It is used to fail NewClientWithOptions fast when a
+// tls.Config was supplied, rather than silently dialing some members in the
+// clear.
+func rejectPlaintextURLs(urls []string) error {
+	for _, u := range urls {
+		if strings.HasPrefix(u, "http://") {
+			return errors.Errorf("[pd] TLS is required but %s is plaintext", u)
+		}
+	}
+	return nil
+}
+
 func addrsToUrls(addrs []string) []string {
-	// Add default schema "http://" to addrs.
+	// Add default schema "http://" to addrs, leaving explicit "https://"
+	// (or any other) schemes supplied by the caller untouched so mixed
+	// plaintext/TLS endpoints can be passed in the same slice.
 	urls := make([]string, 0, len(addrs))
 	for _, addr := range addrs {
 		if strings.Contains(addr, "://") {
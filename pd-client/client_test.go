@@ -0,0 +1,141 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"golang.org/x/net/context"
+)
+
+func TestRejectPlaintextURLsAllowsAllHTTPS(t *testing.T) {
+	if err := rejectPlaintextURLs([]string{"https://a", "https://b"}); err != nil {
+		t.Fatalf("rejectPlaintextURLs() = %v, want nil", err)
+	}
+}
+
+func TestRejectPlaintextURLsRejectsFirstPlaintextAddr(t *testing.T) {
+	err := rejectPlaintextURLs([]string{"https://a", "http://b", "https://c"})
+	if err == nil {
+		t.Fatal("rejectPlaintextURLs() = nil, want an error naming the plaintext address")
+	}
+	if got, want := err.Error(), "http://b"; !strings.Contains(got, want) {
+		t.Fatalf("rejectPlaintextURLs() error = %q, want it to mention %q", got, want)
+	}
+}
+
+// TestFinishTSORequestRangeSlicesMergedBatch drives finishTSORequestRange
+// the way processTSORequests does when a localTSOAllocator lease refill
+// (count > 1) is merged into the same Tso RPC as ordinary GetTS requests
+// (count == 1): each request should get a disjoint, contiguous chunk of
+// logical values out of the granted range, with the lease request's chunk
+// matching what requestTSOLease's old standalone-RPC math returned
+// (ts.GetLogical() - count + 1).
+func TestFinishTSORequestRangeSlicesMergedBatch(t *testing.T) {
+	c := &client{}
+
+	const physical = int64(100)
+	const grantedLogical = int64(20) // resp.GetTimestamp().GetLogical(), the end of the granted range
+
+	ordinary := &tsoRequest{done: make(chan error, 1), count: 1}
+	lease := &tsoRequest{done: make(chan error, 1), count: 10}
+
+	logical := c.finishTSORequestRange(ordinary, physical, grantedLogical)
+	logical = c.finishTSORequestRange(lease, physical, logical)
+
+	if ordinary.physical != physical || ordinary.logical != grantedLogical {
+		t.Fatalf("ordinary request = (physical %d, logical %d), want (%d, %d)", ordinary.physical, ordinary.logical, physical, grantedLogical)
+	}
+	if want := grantedLogical - 1 - int64(lease.count) + 1; lease.logical != want {
+		t.Fatalf("lease request logical start = %d, want %d", lease.logical, want)
+	}
+	if lease.physical != physical {
+		t.Fatalf("lease request physical = %d, want %d", lease.physical, physical)
+	}
+	if want := lease.logical - 1; logical != want {
+		t.Fatalf("remaining logical cursor = %d, want %d", logical, want)
+	}
+
+	// The two chunks must not overlap: ordinary took exactly 1 value
+	// (grantedLogical), lease's range [lease.logical, lease.logical+9]
+	// must end strictly below it.
+	if lease.logical+int64(lease.count)-1 >= ordinary.logical {
+		t.Fatalf("lease chunk [%d, %d] overlaps the ordinary request's value %d", lease.logical, lease.logical+int64(lease.count)-1, ordinary.logical)
+	}
+}
+
+// newTestClientWithCaches builds a *client with just a region/store cache,
+// enough to exercise GetRegion/GetStore's cache-hit path without any
+// clients/health setup, since a hit returns before either is touched.
+func newTestClientWithCaches() *client {
+	return &client{
+		regionCache: newTTLLRUCache(time.Minute, 64),
+		storeCache:  newTTLLRUCache(time.Minute, 64),
+	}
+}
+
+// TestGetRegionServesFromCache asserts GetRegion returns a cached entry
+// without going anywhere near pickClient/c.clients, matching the Client
+// interface doc's promise that results are served from the region cache
+// where possible.
+func TestGetRegionServesFromCache(t *testing.T) {
+	c := newTestClientWithCaches()
+	region := &metapb.Region{StartKey: []byte("a"), EndKey: []byte("z")}
+	leader := &metapb.Peer{Id: 1}
+	c.regionCache.putRegion(region, leader)
+
+	gotRegion, gotLeader, err := c.GetRegion(context.Background(), []byte("m"))
+	if err != nil {
+		t.Fatalf("GetRegion: %v", err)
+	}
+	if gotRegion != region || gotLeader != leader {
+		t.Fatalf("GetRegion() = (%v, %v), want the cached (%v, %v)", gotRegion, gotLeader, region, leader)
+	}
+}
+
+// TestGetStoreServesFromCache asserts GetStore returns a cached store
+// without going anywhere near pickClient/c.clients.
+func TestGetStoreServesFromCache(t *testing.T) {
+	c := newTestClientWithCaches()
+	store := &metapb.Store{Id: 7}
+	c.storeCache.putStore(7, store, false)
+
+	got, err := c.GetStore(context.Background(), 7)
+	if err != nil {
+		t.Fatalf("GetStore: %v", err)
+	}
+	if got != store {
+		t.Fatalf("GetStore() = %v, want the cached %v", got, store)
+	}
+}
+
+// TestGetStoreServesNegativeCacheForTombstone asserts a negatively-cached
+// Tombstone store makes GetStore return (nil, nil) from the cache, just as
+// it would for a fresh RPC response reporting the store as Tombstone.
+func TestGetStoreServesNegativeCacheForTombstone(t *testing.T) {
+	c := newTestClientWithCaches()
+	store := &metapb.Store{Id: 8, State: metapb.StoreState_Tombstone}
+	c.storeCache.putStore(8, store, true)
+
+	got, err := c.GetStore(context.Background(), 8)
+	if err != nil {
+		t.Fatalf("GetStore: %v", err)
+	}
+	if got != nil {
+		t.Fatalf("GetStore() = %v, want nil for a negatively-cached tombstone store", got)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pd
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/kvproto/pkg/pdpb2"
+	"golang.org/x/net/context"
+)
+
+const memberDiscoveryInterval = time.Minute
+
+// EndpointStore persists the set of PD member URLs a client last knew
+// about, so a restarted client can bootstrap from the last known good set
+// rather than only the addresses it was originally constructed with.
+type EndpointStore interface {
+	// Load returns the previously persisted member URLs, or an empty slice
+	// if there is nothing persisted yet.
+	Load() ([]string, error)
+	// Save persists the current member URLs.
+	Save(urls []string) error
+}
+
+// noopEndpointStore is the default EndpointStore: it remembers nothing, so
+// the client always starts from the addresses it was constructed with.
+type noopEndpointStore struct{}
+
+func (noopEndpointStore) Load() ([]string, error)  { return nil, nil }
+func (noopEndpointStore) Save(urls []string) error { return nil }
+
+// discoveryLoop periodically asks the current leader for the cluster's
+// member list and reconciles c.urls/c.clients with it, dialing new members
+// and closing connections to ones that are no longer part of the cluster.
+func (c *client) discoveryLoop() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(memberDiscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.discoverMembers(); err != nil {
+				log.Errorf("[pd] failed to discover members: %v", err)
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *client) discoverMembers() error {
+	urls, err := c.fetchMemberURLs()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+
+	c.reconcileMembers(urls)
+
+	if err := c.endpointStore.Save(urls); err != nil {
+		log.Errorf("[pd] failed to persist discovered members: %v", err)
+	}
+	return nil
+}
+
+// fetchMemberURLs asks the current leader for the cluster's member list and
+// flattens it into a client-URL slice.
+func (c *client) fetchMemberURLs() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pdTimeout)
+	defer cancel()
+
+	resp, err := c.leaderClient().GetMembers(ctx, &pdpb2.GetMembersRequest{})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	urls := make([]string, 0, len(resp.GetMembers()))
+	for _, m := range resp.GetMembers() {
+		for _, addr := range m.GetClientUrls() {
+			urls = append(urls, addr)
+		}
+	}
+	return urls, nil
+}
+
+// reconcileMembers dials every member in urls that isn't already known,
+// closes connections to members that fell out of urls (except the current
+// leader, which stays dialed regardless so in-flight leader RPCs and a
+// subsequent switchLeader back to it keep working), and replaces c.urls.
+// It invokes the registered OnMemberChange callback, if any, with the new
+// set when that set differs from the previous c.urls. Pulled out of discoverMembers so the reconciliation logic can be
+// exercised without a live GetMembers RPC.
+func (c *client) reconcileMembers(urls []string) {
+	current := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		current[u] = true
+	}
+
+	c.mu.Lock()
+	changed := len(c.urls) != len(urls)
+	for _, u := range c.urls {
+		if !current[u] {
+			changed = true
+		}
+	}
+	for addr := range current {
+		if err := c.ensureClientLocked(addr); err != nil {
+			log.Errorf("[pd] failed to dial new member %v: %v", addr, err)
+			delete(current, addr)
+		}
+	}
+	for addr, cc := range c.conns {
+		if current[addr] || addr == c.leader {
+			continue
+		}
+		if err := cc.Close(); err != nil {
+			log.Errorf("[pd] failed to close connection to removed member %v: %v", addr, err)
+		}
+		delete(c.conns, addr)
+		delete(c.clients, addr)
+	}
+	c.urls = urls
+	cb := c.memberChangeCb
+	c.mu.Unlock()
+
+	if cb != nil && changed {
+		cb(urls)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pd
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/pdpb2"
+	"google.golang.org/grpc"
+)
+
+// newTestClientForDiscovery builds a *client with every member in members
+// already dialed, ready to exercise reconcileMembers without a live PD.
+// grpc.Dial with the client's custom dialer is non-blocking, so this dials
+// instantly regardless of whether the addresses are reachable.
+func newTestClientForDiscovery(leader string, members ...string) *client {
+	c := &client{
+		urls:    append([]string{}, members...),
+		clients: make(map[string]pdpb2.PDClient),
+		conns:   make(map[string]*grpc.ClientConn),
+		leader:  leader,
+	}
+	for _, addr := range members {
+		if err := c.ensureClientLocked(addr); err != nil {
+			panic(err)
+		}
+	}
+	return c
+}
+
+// TestReconcileMembersDialsNewAndClosesRemoved exercises discoverMembers'
+// reconciliation: a member no longer reported by PD should be undialed, a
+// newly reported one should be dialed, and c.urls should end up exactly the
+// reported set.
+func TestReconcileMembersDialsNewAndClosesRemoved(t *testing.T) {
+	c := newTestClientForDiscovery("http://leader", "http://leader", "http://stale")
+
+	c.reconcileMembers([]string{"http://leader", "http://fresh"})
+
+	if _, ok := c.clients["http://fresh"]; !ok {
+		t.Fatal("reconcileMembers should have dialed the newly reported member")
+	}
+	if _, ok := c.conns["http://stale"]; ok {
+		t.Fatal("reconcileMembers should have closed the connection to the member no longer reported")
+	}
+	if _, ok := c.clients["http://stale"]; ok {
+		t.Fatal("reconcileMembers should have removed the stale member from clients")
+	}
+	if got, want := c.urls, []string{"http://leader", "http://fresh"}; !sameElements(got, want) {
+		t.Fatalf("c.urls = %v, want %v", got, want)
+	}
+}
+
+// TestReconcileMembersKeepsLeaderConnEvenIfDropped asserts the current
+// leader's connection is never closed by reconciliation, even if PD no
+// longer reports it as a member, since switchLeader/leaderClient depend on
+// it staying dialed until a new leader is chosen.
+func TestReconcileMembersKeepsLeaderConnEvenIfDropped(t *testing.T) {
+	c := newTestClientForDiscovery("http://leader", "http://leader", "http://other")
+
+	c.reconcileMembers([]string{"http://other"})
+
+	if _, ok := c.clients["http://leader"]; !ok {
+		t.Fatal("reconcileMembers should never close the connection to the current leader")
+	}
+}
+
+// TestReconcileMembersInvokesMemberChangeCallback asserts OnMemberChange's
+// callback fires with the newly reconciled set.
+func TestReconcileMembersInvokesMemberChangeCallback(t *testing.T) {
+	c := newTestClientForDiscovery("http://leader", "http://leader")
+
+	var got []string
+	c.OnMemberChange(func(members []string) { got = members })
+
+	c.reconcileMembers([]string{"http://leader", "http://new"})
+
+	if !sameElements(got, []string{"http://leader", "http://new"}) {
+		t.Fatalf("OnMemberChange callback got %v, want %v", got, []string{"http://leader", "http://new"})
+	}
+}
+
+// TestURLsConcurrentReconcileAndSnapshotNoRace stresses reconcileMembers
+// (the writer discoveryLoop drives) against the same RLock-snapshot-RUnlock
+// read pattern updateLeader now uses, reproducing the conditions under
+// which a lock-free read of c.urls would race against discoveryLoop.
+// Run with -race to catch a regression.
+func TestURLsConcurrentReconcileAndSnapshotNoRace(t *testing.T) {
+	c := newTestClientForDiscovery("http://leader", "http://leader")
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.reconcileMembers([]string{"http://leader", "http://member"})
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			c.mu.RLock()
+			urls := append([]string(nil), c.urls...)
+			c.mu.RUnlock()
+			if len(urls) == 0 {
+				t.Error("snapshotted c.urls is unexpectedly empty")
+				return
+			}
+		}
+	}()
+
+	<-done
+	close(stop)
+	wg.Wait()
+}
+
+func sameElements(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		seen[s]--
+	}
+	for _, n := range seen {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pingcap/kvproto/pkg/pdpb2"
+	"golang.org/x/net/context"
+)
+
+const (
+	healthProbeInterval = 10 * time.Second
+	healthProbeTimeout  = 3 * time.Second
+	initialBackoff      = 500 * time.Millisecond
+	maxBackoff          = 30 * time.Second
+)
+
+// memberHealth tracks whether a PD member is currently safe to send
+// requests to, along with the exponential backoff controlling how long it
+// stays excluded after the last failure.
+type memberHealth struct {
+	unhealthyUntil time.Time
+	backoff        time.Duration
+}
+
+// healthBalancer probes every known PD member on a timer and keeps track of
+// which ones are currently healthy, so pickClient can fall back to a
+// healthy follower for read-only calls instead of blocking on a wedged
+// leader.
+type healthBalancer struct {
+	c *client
+
+	mu      sync.Mutex
+	members map[string]*memberHealth
+}
+
+func newHealthBalancer(c *client) *healthBalancer {
+	return &healthBalancer{
+		c:       c,
+		members: make(map[string]*memberHealth),
+	}
+}
+
+// isHealthy reports whether addr is currently safe to send requests to. An
+// address that has never been probed is assumed healthy.
+func (b *healthBalancer) isHealthy(addr string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.members[addr]
+	if !ok {
+		return true
+	}
+	return time.Now().After(m.unhealthyUntil)
+}
+
+// markUnhealthy excludes addr from selection for an exponentially
+// increasing backoff period, capped at maxBackoff.
+func (b *healthBalancer) markUnhealthy(addr string) {
+	if addr == "" {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.members[addr]
+	if !ok {
+		m = &memberHealth{backoff: initialBackoff}
+		b.members[addr] = m
+	} else if m.backoff < maxBackoff {
+		m.backoff *= 2
+		if m.backoff > maxBackoff {
+			m.backoff = maxBackoff
+		}
+	}
+	m.unhealthyUntil = time.Now().Add(m.backoff)
+	log.Warnf("[pd] marking %v unhealthy for %v", addr, m.backoff)
+}
+
+// markHealthy clears any backoff recorded for addr.
+func (b *healthBalancer) markHealthy(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.members, addr)
+}
+
+// pickHealthyFollower returns the first healthy address in candidates, if
+// any. The caller is responsible for building candidates (typically every
+// known member other than the leader) while holding whatever lock guards
+// it; pickHealthyFollower itself does not touch c.mu, so it is safe to call
+// while already holding it.
+func (b *healthBalancer) pickHealthyFollower(candidates []string) (string, bool) {
+	for _, addr := range candidates {
+		if b.isHealthy(addr) {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// probeLoop periodically checks every known PD member with a lightweight
+// GetMembers call, marking members healthy or unhealthy as appropriate.
+func (b *healthBalancer) probeLoop() {
+	defer b.c.wg.Done()
+
+	ticker := time.NewTicker(healthProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.probeAll()
+		case <-b.c.quit:
+			return
+		}
+	}
+}
+
+func (b *healthBalancer) probeAll() {
+	b.c.mu.RLock()
+	clients := make(map[string]pdpb2.PDClient, len(b.c.clients))
+	for addr, cli := range b.c.clients {
+		clients[addr] = cli
+	}
+	b.c.mu.RUnlock()
+
+	for addr, cli := range clients {
+		ctx, cancel := context.WithTimeout(context.Background(), healthProbeTimeout)
+		_, err := cli.GetMembers(ctx, &pdpb2.GetMembersRequest{})
+		cancel()
+		if err != nil {
+			b.markUnhealthy(addr)
+			continue
+		}
+		b.markHealthy(addr)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pd
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/pdpb2"
+)
+
+func TestHealthBalancerUnseenAddressIsHealthy(t *testing.T) {
+	b := newHealthBalancer(nil)
+	if !b.isHealthy("addr-never-probed") {
+		t.Fatal("an address with no recorded health should be assumed healthy")
+	}
+}
+
+func TestHealthBalancerMarkUnhealthyBackoffDoublesAndCaps(t *testing.T) {
+	b := newHealthBalancer(nil)
+
+	b.markUnhealthy("a")
+	if b.isHealthy("a") {
+		t.Fatal("address should be unhealthy immediately after markUnhealthy")
+	}
+	if got := b.members["a"].backoff; got != initialBackoff {
+		t.Fatalf("first backoff = %v, want %v", got, initialBackoff)
+	}
+
+	b.markUnhealthy("a")
+	if got := b.members["a"].backoff; got != initialBackoff*2 {
+		t.Fatalf("second backoff = %v, want %v", got, initialBackoff*2)
+	}
+
+	for i := 0; i < 10; i++ {
+		b.markUnhealthy("a")
+	}
+	if got := b.members["a"].backoff; got != maxBackoff {
+		t.Fatalf("backoff did not cap at maxBackoff: got %v, want %v", got, maxBackoff)
+	}
+
+	b.markHealthy("a")
+	if !b.isHealthy("a") {
+		t.Fatal("address should be healthy again after markHealthy")
+	}
+}
+
+// TestHealthBalancerPickHealthyFollower exercises pickHealthyFollower
+// directly: a healthy candidate is picked, and no candidate is reported once
+// the only one has been marked unhealthy.
+func TestHealthBalancerPickHealthyFollower(t *testing.T) {
+	b := newHealthBalancer(nil)
+
+	addr, ok := b.pickHealthyFollower([]string{"follower"})
+	if !ok || addr != "follower" {
+		t.Fatalf("pickHealthyFollower() = (%q, %v), want (\"follower\", true)", addr, ok)
+	}
+
+	b.markUnhealthy("follower")
+	if _, ok := b.pickHealthyFollower([]string{"follower"}); ok {
+		t.Fatal("pickHealthyFollower() should report no candidate once the only follower is unhealthy")
+	}
+}
+
+// newTestClientWithMembers builds a *client with just enough state for
+// pickClient/health tests: a leader and a set of known member addresses,
+// all dialed (as construction now does for every seed URL).
+func newTestClientWithMembers(leader string, members ...string) *client {
+	clients := make(map[string]pdpb2.PDClient, len(members))
+	for _, addr := range members {
+		clients[addr] = nil
+	}
+	c := &client{leader: leader, clients: clients}
+	c.health = newHealthBalancer(c)
+	return c
+}
+
+// TestPickClientFallsBackToHealthyFollower exercises the fallback through
+// pickClient itself, rather than calling pickHealthyFollower directly, so a
+// regression in how pickClient holds c.mu while consulting the health
+// balancer (it must take exactly one RLock, not a recursive one) is caught
+// here instead of only in a direct unit test of pickHealthyFollower.
+func TestPickClientFallsBackToHealthyFollower(t *testing.T) {
+	c := newTestClientWithMembers("leader", "leader", "follower")
+	c.health.markUnhealthy("leader")
+
+	done := make(chan string, 1)
+	go func() {
+		_, addr := c.pickClient(true)
+		done <- addr
+	}()
+
+	select {
+	case addr := <-done:
+		if addr != "follower" {
+			t.Fatalf("pickClient(true) picked %q, want follower", addr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pickClient(true) deadlocked")
+	}
+}
+
+// TestPickClientConcurrentWithWriterDoesNotDeadlock stresses pickClient
+// concurrently with a goroutine taking c.mu for writing (as switchLeader,
+// dialKnownMembers and reconcileMembers do), reproducing the conditions
+// under which a recursive RLock inside pickClient would deadlock against a
+// queued writer.
+func TestPickClientConcurrentWithWriterDoesNotDeadlock(t *testing.T) {
+	c := newTestClientWithMembers("leader", "leader", "follower")
+	c.health.markUnhealthy("leader")
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.mu.Lock()
+			c.mu.Unlock()
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			c.pickClient(true)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pickClient deadlocked under concurrent writer pressure")
+	}
+	close(stop)
+	wg.Wait()
+}
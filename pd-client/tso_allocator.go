@@ -0,0 +1,316 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// TSOAllocatorType selects the strategy processTSORequests' callers use to
+// obtain timestamps from GetTS.
+type TSOAllocatorType int
+
+const (
+	// RemoteTSOAllocator issues one (merged) Tso RPC per GetTS call, as
+	// the client has always done. It has no local state and is exact but
+	// stalls on PD outages.
+	RemoteTSOAllocator TSOAllocatorType = iota
+	// LocalTSOAllocator pre-fetches a lease of timestamps from PD and
+	// hands them out from an in-memory range, refilling asynchronously.
+	LocalTSOAllocator
+	// HybridTSOAllocator combines the last PD-issued physical time with a
+	// monotonic local counter (HLC-style), so short PD outages do not
+	// stall GetTS callers.
+	HybridTSOAllocator
+)
+
+const (
+	defaultLeaseCount       = 10000
+	defaultRefillWatermark  = defaultLeaseCount / 10
+	defaultHybridRefreshInt = 100 * time.Millisecond
+	// maxHybridDriftMillis bounds how far hybridTSOAllocator.getTS may run
+	// its local clock ahead of the last PD-confirmed physical time. Without
+	// this cap a fast or skewed local clock could race arbitrarily far
+	// ahead between refreshes; ordering is still correct either way, but
+	// keeping the drift small means a PD timestamp observed elsewhere stays
+	// close to the local one, which matters for callers that compare TSO
+	// physical time against wall-clock time (e.g. TTL checks).
+	maxHybridDriftMillis = 10 * int64(defaultHybridRefreshInt/time.Millisecond)
+)
+
+// TSOConfig configures which TSOAllocatorType a client uses and the
+// parameters specific to it.
+type TSOConfig struct {
+	Type TSOAllocatorType
+	// LeaseCount is the number of timestamps LocalTSOAllocator pre-fetches
+	// per lease. Defaults to defaultLeaseCount if zero.
+	LeaseCount uint32
+	// RefillWatermark is the pool size, in timestamps, at or below which
+	// LocalTSOAllocator starts an asynchronous refill. Defaults to
+	// defaultRefillWatermark if zero.
+	RefillWatermark uint32
+}
+
+// tsoAllocator is the internal interface behind Client.GetTS.
+type tsoAllocator interface {
+	getTS(ctx context.Context) (int64, int64, error)
+	close()
+}
+
+func newTSOAllocator(c *client, cfg TSOConfig) (tsoAllocator, error) {
+	switch cfg.Type {
+	case LocalTSOAllocator:
+		leaseCount := cfg.LeaseCount
+		if leaseCount == 0 {
+			leaseCount = defaultLeaseCount
+		}
+		watermark := cfg.RefillWatermark
+		if watermark == 0 {
+			watermark = defaultRefillWatermark
+		}
+		return newLocalTSOAllocator(c.requestTSOLease, leaseCount, watermark), nil
+	case HybridTSOAllocator:
+		return newHybridTSOAllocator(c)
+	default:
+		return &remoteTSOAllocator{c: c}, nil
+	}
+}
+
+// remoteTSOAllocator is the original behavior: every GetTS call merges with
+// any other pending request in c.tsoRequests and waits on a single Tso RPC.
+type remoteTSOAllocator struct {
+	c *client
+}
+
+func (a *remoteTSOAllocator) getTS(ctx context.Context) (int64, int64, error) {
+	return a.c.getTSRemote(ctx)
+}
+
+func (a *remoteTSOAllocator) close() {}
+
+// localTSOAllocator pre-fetches a lease of timestamps from PD and hands
+// them out from an in-memory range, refilling asynchronously once the pool
+// falls to or below refillWatermark so that most GetTS calls never wait on
+// PD at all.
+//
+// Only one lease request may be in flight at a time: refilling is a
+// single-flight gate guarded by cond, so concurrent callers that all
+// observe an exhausted pool block on the same refill instead of each
+// firing their own requestTSOLease RPC and racing to overwrite
+// physical/next/end with a stale, possibly smaller lease.
+type localTSOAllocator struct {
+	// fetch requests a lease of count timestamps, returning the physical
+	// time and the first logical value of the lease. It is
+	// client.requestTSOLease in production and a fake in tests.
+	fetch           func(ctx context.Context, count uint32) (int64, int64, error)
+	leaseCount      uint32
+	refillWatermark uint32
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	physical  int64
+	next      int64 // next logical value to hand out
+	end       int64 // one past the last logical value in the current lease
+	refilling bool
+}
+
+func newLocalTSOAllocator(fetch func(ctx context.Context, count uint32) (int64, int64, error), leaseCount, watermark uint32) *localTSOAllocator {
+	a := &localTSOAllocator{fetch: fetch, leaseCount: leaseCount, refillWatermark: watermark}
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+func (a *localTSOAllocator) getTS(ctx context.Context) (int64, int64, error) {
+	a.mu.Lock()
+	for a.next >= a.end {
+		if a.refilling {
+			a.cond.Wait()
+			continue
+		}
+		a.refilling = true
+		a.mu.Unlock()
+		err := a.refill(ctx)
+		a.mu.Lock()
+		a.refilling = false
+		a.cond.Broadcast()
+		if err != nil {
+			a.mu.Unlock()
+			return 0, 0, errors.Trace(err)
+		}
+	}
+
+	physical, logical := a.physical, a.next
+	a.next++
+	if a.end-a.next <= int64(a.refillWatermark) && !a.refilling {
+		a.refilling = true
+		go a.refillAsync()
+	}
+	a.mu.Unlock()
+
+	return physical, logical, nil
+}
+
+// refill fetches a new lease and installs it. The caller must not hold a.mu.
+func (a *localTSOAllocator) refill(ctx context.Context) error {
+	physical, logicalStart, err := a.fetch(ctx, a.leaseCount)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	a.mu.Lock()
+	a.physical = physical
+	a.next = logicalStart
+	a.end = logicalStart + int64(a.leaseCount)
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *localTSOAllocator) refillAsync() {
+	defer func() {
+		a.mu.Lock()
+		a.refilling = false
+		a.cond.Broadcast()
+		a.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), pdTimeout)
+	defer cancel()
+	if err := a.refill(ctx); err != nil {
+		log.Errorf("[pd] failed to refill local tso lease: %v", err)
+	}
+}
+
+func (a *localTSOAllocator) close() {}
+
+// requestTSOLease asks the leader for a lease of count timestamps,
+// returning the physical time and the first logical value of the lease.
+// It queues onto the same c.tsoRequests channel as ordinary GetTS calls,
+// so tsLoop/processTSORequests merges a lease refill with whatever other
+// requests are pending into a single Tso RPC, the same
+// maxMergeTSORequests batching ordinary traffic gets.
+func (c *client) requestTSOLease(ctx context.Context, count uint32) (int64, int64, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, pdTimeout)
+	defer cancel()
+
+	return c.requestTSO(reqCtx, count, true)
+}
+
+// hybridTSOAllocator is an HLC-style allocator: it hands out timestamps
+// from a monotonic local counter seeded by the latest PD-issued physical
+// time, and refreshes that physical time in the background so GetTS never
+// blocks on PD directly.
+//
+// newHybridTSOAllocator performs one synchronous refresh against PD before
+// returning so that getTS never serves a bare time.Now() reading: TSO's
+// ordering contract requires every issued timestamp to be greater than any
+// timestamp PD has already handed out elsewhere, and an unseeded allocator
+// could race ahead of a local clock that is behind PD's (VM pause, NTP
+// skew, or simply a caller starting a transaction in the first tick after
+// construction).
+type hybridTSOAllocator struct {
+	// fetch fetches the current (physical, logical) timestamp from PD. It
+	// is client.getTSRemote in production and a fake in tests.
+	fetch func(ctx context.Context) (int64, int64, error)
+
+	mu                sync.Mutex
+	physical          int64 // physical time of the next timestamp to hand out
+	logical           int64
+	confirmedPhysical int64 // last PD-confirmed physical time, used to bound drift
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newHybridTSOAllocator(c *client) (*hybridTSOAllocator, error) {
+	return newHybridTSOAllocatorWithFetch(c.getTSRemote)
+}
+
+func newHybridTSOAllocatorWithFetch(fetch func(ctx context.Context) (int64, int64, error)) (*hybridTSOAllocator, error) {
+	a := &hybridTSOAllocator{fetch: fetch, quit: make(chan struct{})}
+	if err := a.refresh(context.Background()); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	a.wg.Add(1)
+	go a.refreshLoop()
+	return a, nil
+}
+
+func (a *hybridTSOAllocator) getTS(ctx context.Context) (int64, int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if now > a.confirmedPhysical+maxHybridDriftMillis {
+		now = a.confirmedPhysical + maxHybridDriftMillis
+	}
+	if now > a.physical {
+		a.physical = now
+		a.logical = 0
+	} else {
+		a.logical++
+	}
+	return a.physical, a.logical, nil
+}
+
+func (a *hybridTSOAllocator) refreshLoop() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(defaultHybridRefreshInt)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.refresh(context.Background()); err != nil {
+				// A PD outage just means we keep ticking forward on the
+				// local clock, bounded by maxHybridDriftMillis; nothing
+				// else to do here.
+				log.Errorf("[pd] failed to refresh hybrid tso baseline: %v", err)
+			}
+		case <-a.quit:
+			return
+		}
+	}
+}
+
+// refresh fetches the current physical time from PD and advances the
+// allocator's baseline if it is ahead of what's already been handed out.
+func (a *hybridTSOAllocator) refresh(ctx context.Context) error {
+	reqCtx, cancel := context.WithTimeout(ctx, pdTimeout)
+	physical, _, err := a.fetch(reqCtx)
+	cancel()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	a.mu.Lock()
+	a.confirmedPhysical = physical
+	if physical > a.physical {
+		a.physical = physical
+		a.logical = 0
+	}
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *hybridTSOAllocator) close() {
+	close(a.quit)
+	a.wg.Wait()
+}
@@ -0,0 +1,184 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pd
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+// TestLocalTSOAllocatorConcurrentRefillMonotonic drives GetTS from many
+// goroutines past pool exhaustion and asserts every issued timestamp is
+// strictly increasing and that refills never overlap: two concurrent
+// callers observing an empty pool must not each fire their own lease
+// request and race to install a stale, smaller lease.
+func TestLocalTSOAllocatorConcurrentRefillMonotonic(t *testing.T) {
+	const (
+		leaseCount   = 8
+		watermark    = 2
+		goroutines   = 50
+		perGoroutine = 20
+	)
+
+	var (
+		nextLeaseStart int64
+		inFlight       int32
+		overlapped     bool
+		mu             sync.Mutex
+	)
+
+	fetch := func(ctx context.Context, count uint32) (int64, int64, error) {
+		if atomic.AddInt32(&inFlight, 1) > 1 {
+			mu.Lock()
+			overlapped = true
+			mu.Unlock()
+		}
+		defer atomic.AddInt32(&inFlight, -1)
+
+		mu.Lock()
+		logicalStart := nextLeaseStart
+		nextLeaseStart += int64(count)
+		mu.Unlock()
+
+		return 1, logicalStart, nil
+	}
+
+	a := newLocalTSOAllocator(fetch, leaseCount, watermark)
+
+	results := make([][2]int64, goroutines*perGoroutine)
+	var idx int64
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := int64(-1)
+			for i := 0; i < perGoroutine; i++ {
+				physical, logical, err := a.getTS(context.Background())
+				if err != nil {
+					t.Errorf("getTS: %v", err)
+					return
+				}
+				if logical <= last {
+					t.Errorf("getTS returned logical %d after %d; timestamps must be strictly increasing", logical, last)
+					return
+				}
+				last = logical
+				n := atomic.AddInt64(&idx, 1) - 1
+				results[n] = [2]int64{physical, logical}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if overlapped {
+		t.Fatal("two lease refills were in flight at the same time")
+	}
+
+	seen := make(map[int64]bool, len(results))
+	for _, r := range results {
+		logical := r[1]
+		if seen[logical] {
+			t.Fatalf("logical timestamp %d handed out more than once", logical)
+		}
+		seen[logical] = true
+	}
+}
+
+// TestNewHybridTSOAllocatorSeedsBeforeFirstGetTS asserts construction blocks
+// on a real fetch against PD, so the very first getTS call after
+// newHybridTSOAllocator returns never serves a bare time.Now() reading that
+// could fall behind a physical time PD has already issued elsewhere.
+func TestNewHybridTSOAllocatorSeedsBeforeFirstGetTS(t *testing.T) {
+	const farFuturePhysical = int64(1) << 42 // far beyond any real wall clock (about year 2109 in ms)
+
+	var fetches int32
+	fetch := func(ctx context.Context) (int64, int64, error) {
+		atomic.AddInt32(&fetches, 1)
+		return farFuturePhysical, 0, nil
+	}
+
+	a, err := newHybridTSOAllocatorWithFetch(fetch)
+	if err != nil {
+		t.Fatalf("newHybridTSOAllocatorWithFetch: %v", err)
+	}
+	defer a.close()
+
+	if got := atomic.LoadInt32(&fetches); got < 1 {
+		t.Fatalf("expected construction to fetch from PD at least once, got %d calls", got)
+	}
+
+	physical, _, err := a.getTS(context.Background())
+	if err != nil {
+		t.Fatalf("getTS: %v", err)
+	}
+	if physical < farFuturePhysical {
+		t.Fatalf("getTS returned physical %d smaller than the seeded PD physical %d; an unseeded local clock reading leaked through", physical, farFuturePhysical)
+	}
+}
+
+// TestNewHybridTSOAllocatorFailsConstructionOnFetchError asserts that if the
+// initial synchronous seed cannot reach PD, construction fails outright
+// rather than silently falling back to an unseeded local clock.
+func TestNewHybridTSOAllocatorFailsConstructionOnFetchError(t *testing.T) {
+	fetchErr := errors.New("pd unreachable")
+	fetch := func(ctx context.Context) (int64, int64, error) {
+		return 0, 0, fetchErr
+	}
+
+	if _, err := newHybridTSOAllocatorWithFetch(fetch); err == nil {
+		t.Fatal("expected newHybridTSOAllocatorWithFetch to fail when the seed fetch errors")
+	}
+}
+
+// TestHybridTSOAllocatorDriftBounded asserts getTS never hands out a
+// physical time more than maxHybridDriftMillis ahead of the last
+// PD-confirmed physical time, even when the local clock has raced far
+// ahead of it.
+func TestHybridTSOAllocatorDriftBounded(t *testing.T) {
+	confirmed := int64(1) << 40
+	fetch := func(ctx context.Context) (int64, int64, error) {
+		return confirmed, 0, nil
+	}
+
+	a, err := newHybridTSOAllocatorWithFetch(fetch)
+	if err != nil {
+		t.Fatalf("newHybridTSOAllocatorWithFetch: %v", err)
+	}
+	defer a.close()
+
+	physical, _, err := a.getTS(context.Background())
+	if err != nil {
+		t.Fatalf("getTS: %v", err)
+	}
+	if max := confirmed + maxHybridDriftMillis; physical > max {
+		t.Fatalf("getTS returned physical %d, exceeding the bound %d above the confirmed PD physical %d", physical, max, confirmed)
+	}
+
+	// Advancing wall-clock time should never matter here: local time is
+	// decades past confirmed, so every call must still clamp to the bound.
+	time.Sleep(time.Millisecond)
+	physical, _, err = a.getTS(context.Background())
+	if err != nil {
+		t.Fatalf("getTS: %v", err)
+	}
+	if max := confirmed + maxHybridDriftMillis; physical > max {
+		t.Fatalf("getTS returned physical %d, exceeding the bound %d above the confirmed PD physical %d", physical, max, confirmed)
+	}
+}